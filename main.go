@@ -1,10 +1,17 @@
 package main
 
 import (
+	"cdn"
+	"database"
 	"distribute"
 	"fmt"
+	"logger"
+	"metrics"
 	"os"
 	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"collect"
 
@@ -21,6 +28,71 @@ func loadEnv() {
 	}
 }
 
+// openStore picks the storage backend for the collect command
+func openStore(backend string) (collect.Store, error) {
+	switch backend {
+	case "memory":
+		return collect.NewMemoryStore(collect.Feed{}), nil
+	case "mongo", "":
+		db := &database.MongoConnection{}
+		if err := db.CreateConnection(); err != nil {
+			return nil, err
+		}
+		store := collect.NewMongoStore(db)
+		if err := store.EnsureIndexes(); err != nil {
+			logger.WithError(err).Warn("Could not create indexes")
+		}
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown store: %s", backend)
+	}
+}
+
+// exit codes of collect and distribute
+const (
+	exitFailed   = 1 // invalid flags or settings
+	exitDatabase = 2 // the database could not be reached or failed during the run
+	exitPartial  = 3 // the run finished but some sections, headlines, uploads or readers failed
+)
+
+// exitHealthUnknown is returned by collect health when the check could not
+// run, UNKNOWN of the nagios convention. Other codes of health are its levels
+const exitHealthUnknown = 3
+
+// exitCode maps errors returned by collect and distribute to exit codes
+func exitCode(err error) int {
+	switch err.(type) {
+	case *database.ConnectionError, *collect.StoreError, *distribute.QueryError:
+		return exitDatabase
+	case *collect.PartialError, *collect.UploadError, *distribute.DeliveryError:
+		return exitPartial
+	default:
+		return exitFailed
+	}
+}
+
+// writeMetrics saves metrics of a one-shot run for the textfile collector
+func writeMetrics(c *cli.Context) {
+	path := c.String("metrics_file")
+	if path == "" {
+		return
+	}
+	if err := metrics.WriteTextfile(path); err != nil {
+		logger.WithError(err).WithField("file", path).Error("Could not write metrics")
+	}
+}
+
+// splitList splits comma separated values
+func splitList(s string) []string {
+	var list []string
+	for _, value := range strings.Split(s, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			list = append(list, value)
+		}
+	}
+	return list
+}
+
 func main() {
 	loadEnv()
 
@@ -36,6 +108,37 @@ func main() {
 		},
 	}
 
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "log-format",
+			Usage: "Format of log entries (text or json)",
+			Value: "text",
+		},
+		cli.StringFlag{
+			Name:  "log-level",
+			Usage: "Minimum level of log entries (debug, info, warn or error)",
+			Value: "info",
+		},
+		cli.StringFlag{
+			Name:   "metrics_addr",
+			Usage:  "Serve metrics on `ADDR` under /metrics while the command runs (e.g. :9100)",
+			EnvVar: "METRICS_ADDR",
+		},
+	}
+	app.Before = func(c *cli.Context) error {
+		if err := logger.Configure(c.String("log-format"), c.String("log-level")); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		if addr := c.String("metrics_addr"); addr != "" {
+			go func() {
+				if err := metrics.Serve(addr); err != nil {
+					logger.WithError(err).WithField("addr", addr).Error("Could not serve metrics")
+				}
+			}()
+		}
+		return nil
+	}
+
 	app.Commands = []cli.Command{
 		{
 			Name:     "distribute",
@@ -71,7 +174,11 @@ func main() {
 							// 	Pattern:    c.String("pattern"),
 						}
 						distribute.SetOptions(options)
-						distribute.Execute()
+						err := distribute.Execute()
+						writeMetrics(c)
+						if err != nil {
+							return cli.NewExitError(err.Error(), exitCode(err))
+						}
 						fmt.Println("SENT!")
 
 						return nil
@@ -85,6 +192,137 @@ func main() {
 							Name:  "email, e",
 							Usage: "Send newsletter to this `EMAIL` (multiple emails separated by comma e.g. email@email1.com,email2@email1.com)",
 						},
+						cli.StringFlag{
+							Name:   "metrics_file",
+							Usage:  "Write metrics of the run to `FILE` for the node exporter textfile collector",
+							EnvVar: "METRICS_FILE",
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:     "cdn",
+			Category: "Services",
+			Usage:    "Manage images in the CDN",
+			Subcommands: []cli.Command{
+				{
+					Name:  "sync",
+					Usage: "Upload images left in the temp folder, files already in the CDN are only recorded",
+					Action: func(c *cli.Context) error {
+						storage, err := cdn.OpenStorage(c.String("cdn"))
+						if err != nil {
+							return cli.NewExitError(err.Error(), 1)
+						}
+
+						cdn.SetOptions(cdn.Options{
+							CacheControl: c.String("cache_control"),
+							Retries:      c.Int("upload_retries"),
+							DryRun:       c.Bool("dry-run"),
+						})
+
+						report := cdn.Upload(storage, c.String("subfolder"), c.Int("upload_clusters"), c.String("source"), c.String("manifest_dir"))
+						report.Print(os.Stdout)
+						if len(report.Failed) > 0 {
+							return cli.NewExitError("", 1)
+						}
+						return nil
+					},
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "cdn",
+							Usage: "Where images are uploaded, s3://bucket?region=REGION&acl=ACL or file:///path",
+							Value: "s3://thepressreview?region=us-east-1&acl=public-read",
+						},
+						cli.StringFlag{
+							Name:  "source",
+							Usage: "Folder with images to upload",
+							Value: "./tmp/",
+						},
+						cli.StringFlag{
+							Name:  "subfolder",
+							Usage: "Folder in the CDN",
+							Value: "images/",
+						},
+						cli.StringFlag{
+							Name:  "manifest_dir",
+							Usage: "Folder of the upload manifest",
+							Value: "./uploaded/",
+						},
+						cli.IntFlag{
+							Name:  "upload_clusters",
+							Usage: "Number of workers for upload images to CDN",
+							Value: 100,
+						},
+						cli.StringFlag{
+							Name:  "cache_control",
+							Usage: "Cache-Control header of uploaded images",
+							Value: "public, max-age=31536000, immutable",
+						},
+						cli.IntFlag{
+							Name:  "upload_retries",
+							Usage: "Number of retries of a failed upload",
+							Value: 3,
+						},
+						cli.BoolFlag{
+							Name:  "dry-run",
+							Usage: "Only print files to be uploaded",
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:     "headlines",
+			Category: "Reports",
+			Usage:    "Inspect saved headlines",
+			Subcommands: []cli.Command{
+				{
+					Name:  "revisions",
+					Usage: "List headlines rewritten under the same URL",
+					Action: func(c *cli.Context) error {
+						store, err := openStore(c.String("store"))
+						if err != nil {
+							return cli.NewExitError(err.Error(), 1)
+						}
+						defer store.Close()
+
+						since := time.Now().Add(-time.Duration(c.Int("days")) * 24 * time.Hour)
+						newspaper, err := store.RevisedHeadlines(c.String("channel"), since)
+						if err != nil {
+							return cli.NewExitError(err.Error(), 1)
+						}
+
+						w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+						for _, news := range newspaper {
+							fmt.Fprintf(w, "%s\t%s\n", news.Channel, news.Link)
+							for _, revision := range news.Revisions {
+								fmt.Fprintf(w, "\t%s\t%s\n", revision.SeenAt.Format("2006-01-02 15:04"), revision.Title)
+								if revision.Description != "" {
+									fmt.Fprintf(w, "\t\t%s\n", revision.Description)
+								}
+							}
+						}
+						w.Flush()
+						fmt.Println("Rewritten headlines:", len(newspaper))
+
+						return nil
+					},
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "channel",
+							Usage: "Only headlines of this channel `CODE`",
+						},
+						cli.IntFlag{
+							Name:  "days",
+							Usage: "Only headlines rewritten in the last `DAYS` days",
+							Value: 7,
+						},
+						cli.StringFlag{
+							Name:  "store",
+							Usage: "Storage backend with headlines (mongo or memory)",
+							Value: "mongo",
+						},
 					},
 				},
 			},
@@ -96,32 +334,87 @@ func main() {
 			Usage:    "Parse websites for news headlines",
 			Action: func(c *cli.Context) error {
 				if c.NumFlags() == 0 {
-					return cli.ShowCommandHelp(c, "collect")
+					return cli.ShowSubcommandHelp(c)
 					// return cli.NewExitError("Some flags are required. Use --help for more info.", 0)
 				}
 
+				if c.Bool("log") {
+					logger.Configure(c.GlobalString("log-format"), "debug")
+				}
+
+				switch c.String("report") {
+				case "table", "json", "none":
+				default:
+					return cli.NewExitError(fmt.Sprintf("unknown report format: %s", c.String("report")), exitFailed)
+				}
+
 				options := collect.Options{
-					LogMode:    c.Bool("log"),
-					TestMode:   c.Bool("test"),
-					AllMode:    c.Bool("all"),
-					Channels:   c.String("channels"),
-					Sections:   c.String("sections"),
-					SaveMode:   c.Bool("save"),
-					UploadMode: c.Bool("upload"),
-					Clusters:   c.Int("upload_clusters"),
-					Limit:      c.Int("limit"),
-					URL:        c.String("url"),
-					Pattern:    c.String("pattern"),
+					TestMode:        c.Bool("test"),
+					AllMode:         c.Bool("all"),
+					Channels:        c.String("channels"),
+					Sections:        c.String("sections"),
+					SaveMode:        c.Bool("save"),
+					UploadMode:      c.Bool("upload"),
+					Clusters:        c.Int("upload_clusters"),
+					Concurrency:     c.Int("concurrency"),
+					HostConcurrency: c.Int("host_concurrency"),
+					Limit:           c.Int("limit"),
+					URL:             c.String("url"),
+					Patterns:        c.StringSlice("pattern"),
+					Exclude:         c.StringSlice("exclude"),
+					ExcludeLinks:    c.StringSlice("exclude-link"),
+					Format:          c.String("format"),
+					TrackingParams:  splitList(c.String("tracking_params")),
+					ImageWorkers:    c.Int("image_workers"),
+					StreamImages:    c.Bool("stream_images"),
+					RepeatedImages:  c.Int("placeholder_threshold"),
+					MinImageWidth:   c.Int("min_image_width"),
+					MinImageHeight:  c.Int("min_image_height"),
+					ReportFormat:    c.String("report"),
+					CDN:             c.String("cdn"),
+				}
+				if c.String("renditions") != "" {
+					renditions, err := collect.LoadRenditions(c.String("renditions"))
+					if err != nil {
+						return cli.NewExitError(err.Error(), 1)
+					}
+					options.Renditions = renditions
 				}
 				collect.SetOptions(options)
-				collect.Execute()
+				cdn.SetOptions(cdn.Options{
+					CacheControl: c.String("cache_control"),
+					Retries:      c.Int("upload_retries"),
+				})
+
+				// Testing patterns does not need a database
+				backend := c.String("store")
+				if !c.IsSet("store") && !options.AllMode && !options.SaveMode {
+					backend = "memory"
+				}
+
+				// the memory store starts without channels, --all would find none
+				if backend == "memory" && options.AllMode {
+					return cli.NewExitError("--all reads channels from the database, it cannot be used with --store memory", exitFailed)
+				}
+
+				store, err := openStore(backend)
+				if err != nil {
+					return cli.NewExitError(err.Error(), exitCode(err))
+				}
+				defer store.Close()
+
+				_, err = collect.Execute(store)
+				writeMetrics(c)
+				if err != nil {
+					return cli.NewExitError(err.Error(), exitCode(err))
+				}
 
 				return nil
 			},
 			Flags: []cli.Flag{
 				cli.BoolFlag{
 					Name:  "log, l",
-					Usage: "Enable logging",
+					Usage: "Log debug entries, same as the global --log-level debug",
 				},
 				cli.BoolFlag{
 					Name:  "test, t",
@@ -152,6 +445,59 @@ func main() {
 					Usage: "Number of workers for upload images to CDN",
 					Value: 100,
 				},
+				cli.StringFlag{
+					Name:  "cdn",
+					Usage: "Where images are uploaded, s3://bucket?region=REGION&acl=ACL or file:///path",
+					Value: "s3://thepressreview?region=us-east-1&acl=public-read",
+				},
+				cli.StringFlag{
+					Name:  "cache_control",
+					Usage: "Cache-Control header of uploaded images",
+					Value: "public, max-age=31536000, immutable",
+				},
+				cli.IntFlag{
+					Name:  "upload_retries",
+					Usage: "Number of retries of a failed upload",
+					Value: 3,
+				},
+				cli.IntFlag{
+					Name:  "min_image_width",
+					Usage: "Skip images narrower than this",
+					Value: 200,
+				},
+				cli.IntFlag{
+					Name:  "min_image_height",
+					Usage: "Skip images lower than this",
+					Value: 100,
+				},
+				cli.IntFlag{
+					Name:  "placeholder_threshold",
+					Usage: "Drop images repeated in this many articles of a channel as placeholders",
+					Value: 5,
+				},
+				cli.BoolFlag{
+					Name:  "stream_images",
+					Usage: "Upload images right after making renditions, without the ./tmp folder",
+				},
+				cli.IntFlag{
+					Name:  "image_workers",
+					Usage: "Number of workers making image renditions",
+					Value: 4,
+				},
+				cli.StringFlag{
+					Name:  "renditions",
+					Usage: "JSON `FILE` with image renditions (name, width, height, crop, format, quality, resize_height)",
+				},
+				cli.IntFlag{
+					Name:  "concurrency",
+					Usage: "Number of sections parsed at the same time",
+					Value: 8,
+				},
+				cli.IntFlag{
+					Name:  "host_concurrency",
+					Usage: "Number of sections of the same host parsed at the same time",
+					Value: 2,
+				},
 				cli.IntFlag{
 					Name:  "limit",
 					Usage: "Number of items per feed",
@@ -161,9 +507,136 @@ func main() {
 					Name:  "url",
 					Usage: "URL to a website",
 				},
-				cli.StringFlag{
+				cli.StringSliceFlag{
 					Name:  "pattern",
-					Usage: "Pattern to parse a website",
+					Usage: "Pattern to parse a website (repeat to try fallback patterns in order)",
+				},
+				cli.StringSliceFlag{
+					Name:  "exclude",
+					Usage: "Skip elements matching or inside this selector (repeatable)",
+				},
+				cli.StringSliceFlag{
+					Name:  "exclude-link",
+					Usage: "Skip links matching this regular expression (repeatable)",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Usage: "Format of a website in test mode (html, rss, json, sitemap)",
+					Value: "html",
+				},
+				cli.StringFlag{
+					Name:   "metrics_file",
+					Usage:  "Write metrics of the run to `FILE` for the node exporter textfile collector",
+					EnvVar: "METRICS_FILE",
+				},
+				cli.StringFlag{
+					Name:  "report",
+					Usage: "Format of the run report (table, json or none)",
+					Value: "table",
+				},
+				cli.StringFlag{
+					Name:  "store",
+					Usage: "Storage backend for channels and headlines (mongo or memory)",
+					Value: "mongo",
+				},
+				cli.StringFlag{
+					Name:  "tracking_params",
+					Usage: "Query parameters removed from links (separated by comma, e.g. utm_*,WT.nav)",
+				},
+			},
+			Subcommands: []cli.Command{
+				{
+					Name:  "health",
+					Usage: "Report sections returning no or much fewer headlines than usual",
+					Description: "Exit codes follow the nagios convention: 0 OK, 1 WARNING, 2 CRITICAL and 3 UNKNOWN\n" +
+						"   when the check could not run, e.g. the database is not reachable",
+					Action: func(c *cli.Context) error {
+						store, err := openStore(c.String("store"))
+						if err != nil {
+							return cli.NewExitError(err.Error(), exitHealthUnknown)
+						}
+						defer store.Close()
+
+						since := time.Now().Add(-time.Duration(c.Int("days")) * 24 * time.Hour)
+						report, err := collect.CheckHealth(store, since, c.Float64("threshold"))
+						if err != nil {
+							return cli.NewExitError(err.Error(), exitHealthUnknown)
+						}
+
+						level := collect.HealthOK
+						w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+						fmt.Fprintln(w, "LEVEL\tCHANNEL\tSECTION\tCOUNT\tAVERAGE\tSTATUS\tURL")
+						for _, health := range report {
+							if health.Level > level {
+								level = health.Level
+							}
+							if health.Level == collect.HealthOK && !c.Bool("all") {
+								continue
+							}
+							fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%.1f\t%d\t%s\n", health.LevelName(), health.Channel, health.Section, health.Latest.Count, health.Average, health.Latest.Status, health.URL)
+						}
+						w.Flush()
+
+						// exit codes follow the nagios convention: 0 OK, 1 WARNING, 2 CRITICAL, see exitHealthUnknown
+						if level != collect.HealthOK {
+							return cli.NewExitError("", level)
+						}
+						return nil
+					},
+					Flags: []cli.Flag{
+						cli.IntFlag{
+							Name:  "days",
+							Usage: "Compare with section runs of the last `DAYS` days",
+							Value: 7,
+						},
+						cli.Float64Flag{
+							Name:  "threshold",
+							Usage: "Warn when the latest count is below this fraction of the average",
+							Value: 0.5,
+						},
+						cli.BoolFlag{
+							Name:  "all",
+							Usage: "List healthy sections too",
+						},
+						cli.StringFlag{
+							Name:  "store",
+							Usage: "Storage backend with section runs (mongo or memory)",
+							Value: "mongo",
+						},
+					},
+				},
+				{
+					Name:  "normalize",
+					Usage: "Normalize links of saved headlines and merge duplicates",
+					Action: func(c *cli.Context) error {
+						collect.SetOptions(collect.Options{
+							TrackingParams: splitList(c.String("tracking_params")),
+						})
+
+						store, err := openStore("mongo")
+						if err != nil {
+							return cli.NewExitError(err.Error(), 1)
+						}
+						defer store.Close()
+
+						merged, err := collect.MigrateLinks(store, c.Bool("dry-run"))
+						if err != nil {
+							return cli.NewExitError(err.Error(), 1)
+						}
+						fmt.Println("Merged headlines:", merged)
+
+						return nil
+					},
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "dry-run",
+							Usage: "Only print headlines to be merged",
+						},
+						cli.StringFlag{
+							Name:  "tracking_params",
+							Usage: "Query parameters removed from links (separated by comma, e.g. utm_*,WT.nav)",
+						},
+					},
 				},
 			},
 		},